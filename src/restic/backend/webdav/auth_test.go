@@ -0,0 +1,87 @@
+package webdav
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSplitDigestParams(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{`realm="foo", nonce="bar"`, []string{`realm="foo"`, ` nonce="bar"`}},
+		{`realm="foo, bar", nonce="baz"`, []string{`realm="foo, bar"`, ` nonce="baz"`}},
+		{`nonce="abc"`, []string{`nonce="abc"`}},
+	}
+
+	for _, test := range tests {
+		got := splitDigestParams(test.in)
+		if len(got) != len(test.want) {
+			t.Errorf("splitDigestParams(%q) = %v, want %v", test.in, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("splitDigestParams(%q)[%d] = %q, want %q", test.in, i, got[i], test.want[i])
+			}
+		}
+	}
+}
+
+func TestParseDigestChallenge(t *testing.T) {
+	header := `Digest realm="example.com", nonce="abc123", qop="auth,auth-int", opaque="xyz"`
+
+	c, ok := parseDigestChallenge(header)
+	if !ok {
+		t.Fatalf("parseDigestChallenge(%q) returned ok=false", header)
+	}
+
+	if c.realm != "example.com" {
+		t.Errorf("realm = %q, want %q", c.realm, "example.com")
+	}
+	if c.nonce != "abc123" {
+		t.Errorf("nonce = %q, want %q", c.nonce, "abc123")
+	}
+	if c.opaque != "xyz" {
+		t.Errorf("opaque = %q, want %q", c.opaque, "xyz")
+	}
+	if c.qop != "auth" {
+		t.Errorf("qop = %q, want %q", c.qop, "auth")
+	}
+}
+
+func TestParseDigestChallengeRejectsNonDigest(t *testing.T) {
+	if _, ok := parseDigestChallenge(`Basic realm="example.com"`); ok {
+		t.Fatalf("parseDigestChallenge accepted a non-Digest header")
+	}
+}
+
+func TestParseDigestChallengeRequiresNonce(t *testing.T) {
+	if _, ok := parseDigestChallenge(`Digest realm="example.com"`); ok {
+		t.Fatalf("parseDigestChallenge accepted a header without a nonce")
+	}
+}
+
+// TestDigestAuthHeaderIncrementsNC ensures every call to digestAuthHeader
+// advances the shared challenge's nonce-count, which RFC 7616 servers use
+// to detect replayed requests.
+func TestDigestAuthHeaderIncrementsNC(t *testing.T) {
+	tr := &authTransport{user: "alice", password: "secret"}
+	c := &digestChallenge{realm: "example.com", nonce: "abc123", qop: "auth"}
+
+	req, err := http.NewRequest("GET", "http://example.com/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := tr.digestAuthHeader(req, c)
+	second := tr.digestAuthHeader(req, c)
+
+	if first == second {
+		t.Fatalf("digestAuthHeader returned the same header twice: %q", first)
+	}
+	if c.nc != 2 {
+		t.Fatalf("c.nc = %d, want 2", c.nc)
+	}
+}
@@ -0,0 +1,65 @@
+package webdav
+
+import (
+	"sync"
+	"time"
+
+	"restic"
+)
+
+// statEntry is one cached Stat result.
+type statEntry struct {
+	size    int64
+	expires time.Time
+}
+
+// statCache caches blob sizes for a TTL, to avoid the HEAD request Stat
+// would otherwise make for every call. "restic check" in particular calls
+// Stat (via Test) for every file in the repository, so this turns what
+// would be hundreds of thousands of HEAD round-trips into a handful.
+//
+// A zero-value statCache (ttl == 0) never caches anything, so callers that
+// need strict consistency can opt out by setting Config.StatCacheTTL to zero.
+type statCache struct {
+	ttl time.Duration
+	m   sync.Map // restic.Handle -> statEntry
+}
+
+func newStatCache(ttl time.Duration) *statCache {
+	return &statCache{ttl: ttl}
+}
+
+// get returns the cached size for h, if an unexpired entry exists.
+func (c *statCache) get(h restic.Handle) (int64, bool) {
+	if c.ttl <= 0 {
+		return 0, false
+	}
+
+	v, ok := c.m.Load(h)
+	if !ok {
+		return 0, false
+	}
+
+	e := v.(statEntry)
+	if time.Now().After(e.expires) {
+		c.m.Delete(h)
+		return 0, false
+	}
+
+	return e.size, true
+}
+
+// set stores size for h, valid until the cache's TTL elapses.
+func (c *statCache) set(h restic.Handle, size int64) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.m.Store(h, statEntry{size: size, expires: time.Now().Add(c.ttl)})
+}
+
+// invalidate removes any cached entry for h, e.g. after h has been removed
+// from the backend.
+func (c *statCache) invalidate(h restic.Handle) {
+	c.m.Delete(h)
+}
@@ -0,0 +1,56 @@
+package webdav
+
+import (
+	"testing"
+	"time"
+
+	"restic"
+)
+
+func TestStatCacheHitAndInvalidate(t *testing.T) {
+	c := newStatCache(time.Minute)
+	h := restic.Handle{Type: restic.DataFile, Name: "abcdef"}
+
+	if _, ok := c.get(h); ok {
+		t.Fatalf("get on empty cache returned ok=true")
+	}
+
+	c.set(h, 1234)
+
+	size, ok := c.get(h)
+	if !ok {
+		t.Fatalf("get after set returned ok=false")
+	}
+	if size != 1234 {
+		t.Fatalf("get returned size %d, want 1234", size)
+	}
+
+	c.invalidate(h)
+
+	if _, ok := c.get(h); ok {
+		t.Fatalf("get after invalidate returned ok=true")
+	}
+}
+
+func TestStatCacheExpiry(t *testing.T) {
+	c := newStatCache(time.Millisecond)
+	h := restic.Handle{Type: restic.DataFile, Name: "abcdef"}
+
+	c.set(h, 1234)
+	time.Sleep(10 * time.Millisecond)
+
+	if _, ok := c.get(h); ok {
+		t.Fatalf("get returned ok=true for an entry past its TTL")
+	}
+}
+
+func TestStatCacheDisabled(t *testing.T) {
+	c := newStatCache(0)
+	h := restic.Handle{Type: restic.DataFile, Name: "abcdef"}
+
+	c.set(h, 1234)
+
+	if _, ok := c.get(h); ok {
+		t.Fatalf("get returned ok=true for a zero-TTL (disabled) cache")
+	}
+}
@@ -2,16 +2,87 @@ package webdav
 
 import (
 	"net/url"
+	"os"
 	"strings"
+	"time"
 
 	"restic/errors"
 )
 
+// LockMode selects whether and how webdavBackend acquires WebDAV locks
+// before modifying resources on the server.
+type LockMode string
+
+// Supported lock modes for Config.LockMode.
+const (
+	LockModeNone      LockMode = "none"
+	LockModeShared    LockMode = "shared"
+	LockModeExclusive LockMode = "exclusive"
+)
+
+// defaultLockTimeout is used when Config.LockTimeout is not set.
+const defaultLockTimeout = 5 * time.Minute
+
+// Defaults used when the corresponding Config fields are not set, matching
+// how the REST/S3 backends parameterize concurrency and retries.
+const (
+	defaultConnections  = 5
+	defaultMaxRetries   = 5
+	defaultRetryBackoff = 500 * time.Millisecond
+	defaultStatCacheTTL = 30 * time.Second
+)
+
 // Config contains all configuration necessary to connect to a WebDAV server.
 type Config struct {
 	URL *url.URL
+
+	// LockMode selects whether resources are locked via WebDAV LOCK before
+	// they are written or removed. Defaults to LockModeNone: not every
+	// WebDAV server implements RFC 4918 LOCK (plain mod_dav/nginx-dav
+	// setups, or restic's own read-only "serve --webdav" often don't), so
+	// locking is opt-in rather than something that can break an existing
+	// repository on upgrade.
+	LockMode LockMode
+
+	// LockTimeout is the timeout requested for a lock. The lock is
+	// refreshed in the background well before it expires. Defaults to
+	// defaultLockTimeout.
+	LockTimeout time.Duration
+
+	// User and Password enable HTTP Basic or Digest authentication,
+	// whichever the server challenges for. If Password is not given
+	// directly (e.g. embedded in the URL), ParseConfig falls back to the
+	// RESTIC_WEBDAV_PASSWORD environment variable, then to .netrc.
+	User     string
+	Password string
+
+	// BearerToken, when set, is sent as an "Authorization: Bearer" header
+	// and takes precedence over User/Password.
+	BearerToken string
+
+	// ClientCert and ClientKey are paths to a PEM-encoded certificate and
+	// key used for mutual TLS authentication against the server.
+	ClientCert string
+	ClientKey  string
+
+	// Connections limits the number of concurrent HTTP requests the
+	// backend issues. Defaults to defaultConnections.
+	Connections int
+
+	// MaxRetries is the number of attempts made to save a file before
+	// giving up. Defaults to defaultMaxRetries.
+	MaxRetries int
+
+	// StatCacheTTL is how long a Stat result is cached before it is
+	// refreshed with a new HEAD request. Defaults to defaultStatCacheTTL;
+	// set to zero to disable the cache entirely.
+	StatCacheTTL time.Duration
 }
 
+// envPasswordKey is the environment variable consulted for the WebDAV
+// password when it is not embedded in the backend specification.
+const envPasswordKey = "RESTIC_WEBDAV_PASSWORD"
+
 // ParseConfig parses the string s and extracts the REST server URL.
 func ParseConfig(s string) (interface{}, error) {
 	if !strings.HasPrefix(s, "webdav:") {
@@ -25,6 +96,32 @@ func ParseConfig(s string) (interface{}, error) {
 		return nil, errors.Wrap(err, "url.Parse")
 	}
 
-	cfg := Config{URL: u}
+	cfg := Config{
+		URL:          u,
+		LockMode:     LockModeNone,
+		LockTimeout:  defaultLockTimeout,
+		Connections:  defaultConnections,
+		MaxRetries:   defaultMaxRetries,
+		StatCacheTTL: defaultStatCacheTTL,
+	}
+
+	if u.User != nil {
+		cfg.User = u.User.Username()
+		cfg.Password, _ = u.User.Password()
+		u.User = nil
+	}
+
+	if cfg.Password == "" {
+		if pw := os.Getenv(envPasswordKey); pw != "" {
+			cfg.Password = pw
+		}
+	}
+
+	if cfg.User != "" && cfg.Password == "" {
+		if pw, err := netrcPassword(u.Hostname()); err == nil {
+			cfg.Password = pw
+		}
+	}
+
 	return cfg, nil
 }
@@ -0,0 +1,72 @@
+package webdav
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"restic/errors"
+)
+
+// netrcPassword returns the password configured for machine in the user's
+// .netrc file, as a fallback for credentials that are not given directly
+// in the backend specification or the environment.
+func netrcPassword(machine string) (string, error) {
+	path := os.Getenv("NETRC")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", errors.Wrap(err, "UserHomeDir")
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrap(err, "Open")
+	}
+	defer f.Close()
+
+	fields := strings.Fields(readerToString(f))
+
+	var currentMachine, login, password string
+	matched := false
+
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "machine":
+			if i+1 < len(fields) {
+				currentMachine = fields[i+1]
+				matched = currentMachine == machine
+				login, password = "", ""
+			}
+		case "login":
+			if i+1 < len(fields) {
+				login = fields[i+1]
+			}
+		case "password":
+			if i+1 < len(fields) {
+				password = fields[i+1]
+			}
+		}
+
+		if matched && login != "" && password != "" {
+			return password, nil
+		}
+	}
+
+	return "", errors.Errorf("no entry for machine %v in %v", machine, path)
+}
+
+// readerToString reads all of f into a string. Used instead of ioutil so a
+// malformed .netrc never causes more than a missed credential lookup.
+func readerToString(f *os.File) string {
+	var sb strings.Builder
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		sb.WriteString(scanner.Text())
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -1,9 +1,32 @@
 package webdav
 
+// Multistatus is the body of a PROPFIND response, as described in RFC 4918
+// section 13.
 type Multistatus struct {
-	Response []struct {
-		HREF string
-	}
+	Response []Response `xml:"response"`
+}
+
+// Response describes one resource found by a PROPFIND request.
+type Response struct {
+	Href     string   `xml:"href"`
+	Propstat Propstat `xml:"propstat"`
+}
+
+// Propstat holds the properties returned for one Response.
+type Propstat struct {
+	Prop Prop `xml:"prop"`
+}
+
+// Prop holds the subset of DAV properties this backend cares about.
+type Prop struct {
+	ResourceType     ResourceType `xml:"resourcetype"`
+	GetContentLength int64        `xml:"getcontentlength"`
+}
+
+// ResourceType's Collection field is non-nil for collections and nil for
+// regular resources.
+type ResourceType struct {
+	Collection *struct{} `xml:"collection"`
 }
 
 //  <?xml version="1.0" encoding="utf-8"?>
@@ -0,0 +1,60 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"testing"
+)
+
+const testMultistatus = `<?xml version="1.0" encoding="utf-8"?>
+<D:multistatus xmlns:D="DAV:">
+	<D:response>
+		<D:href>/data/</D:href>
+		<D:propstat>
+			<D:prop>
+				<D:resourcetype><D:collection/></D:resourcetype>
+			</D:prop>
+			<D:status>HTTP/1.1 200 OK</D:status>
+		</D:propstat>
+	</D:response>
+	<D:response>
+		<D:href>/data/ab/abcdef</D:href>
+		<D:propstat>
+			<D:prop>
+				<D:resourcetype/>
+				<D:getcontentlength>1234</D:getcontentlength>
+			</D:prop>
+			<D:status>HTTP/1.1 200 OK</D:status>
+		</D:propstat>
+	</D:response>
+</D:multistatus>
+`
+
+func TestMultistatusUnmarshal(t *testing.T) {
+	var ms Multistatus
+	if err := xml.Unmarshal([]byte(testMultistatus), &ms); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ms.Response) != 2 {
+		t.Fatalf("got %d responses, want 2", len(ms.Response))
+	}
+
+	dir := ms.Response[0]
+	if dir.Href != "/data/" {
+		t.Errorf("dir Href = %q, want %q", dir.Href, "/data/")
+	}
+	if dir.Propstat.Prop.ResourceType.Collection == nil {
+		t.Errorf("dir ResourceType.Collection = nil, want non-nil")
+	}
+
+	file := ms.Response[1]
+	if file.Href != "/data/ab/abcdef" {
+		t.Errorf("file Href = %q, want %q", file.Href, "/data/ab/abcdef")
+	}
+	if file.Propstat.Prop.ResourceType.Collection != nil {
+		t.Errorf("file ResourceType.Collection = %v, want nil", file.Propstat.Prop.ResourceType.Collection)
+	}
+	if file.Propstat.Prop.GetContentLength != 1234 {
+		t.Errorf("file GetContentLength = %d, want 1234", file.Propstat.Prop.GetContentLength)
+	}
+}
@@ -2,20 +2,59 @@ package webdav
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"path"
 	"restic"
 	"strings"
+	"sync"
+	"time"
 
 	"encoding/xml"
 	"restic/backend"
+	"restic/debug"
 	"restic/errors"
 )
 
-const connLimit = 10
+// lockOwner identifies this restic process as the owner of WebDAV locks it
+// acquires.
+const lockOwner = "urn:restic:backend:webdav"
+
+const lockInfoXML = `<?xml version="1.0" encoding="utf-8" ?>
+<D:lockinfo xmlns:D="DAV:">
+  <D:lockscope><D:%s/></D:lockscope>
+  <D:locktype><D:write/></D:locktype>
+  <D:owner><D:href>%s</D:href></D:owner>
+</D:lockinfo>`
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8" ?>
+<D:propfind xmlns:D="DAV:">
+  <D:prop>
+    <D:resourcetype/>
+    <D:getcontentlength/>
+  </D:prop>
+</D:propfind>`
+
+// collectionPaths lists the top-level collections a webdav repository is
+// made up of.
+var collectionPaths = []string{
+	backend.Paths.Data,
+	backend.Paths.Index,
+	backend.Paths.Keys,
+	backend.Paths.Locks,
+	backend.Paths.Snapshots,
+}
+
+// lockEntry tracks an outstanding WebDAV lock on a resource and the
+// goroutine that keeps it alive.
+type lockEntry struct {
+	token string
+	done  chan struct{}
+}
 
 // restPath returns the path to the given resource.
 func restPath(url *url.URL, h restic.Handle) string {
@@ -50,18 +89,274 @@ type webdavBackend struct {
 	url      *url.URL
 	connChan chan struct{}
 	client   http.Client
+
+	lockMode    LockMode
+	lockTimeout time.Duration
+	lockMu      sync.Mutex
+	locks       map[string]*lockEntry
+
+	maxRetries   int
+	retryBackoff time.Duration
+
+	cache *statCache
 }
 
 // Open opens the REST backend with the given config.
 func Open(cfg Config) (restic.Backend, error) {
-	connChan := make(chan struct{}, connLimit)
-	for i := 0; i < connLimit; i++ {
+	connections := cfg.Connections
+	if connections <= 0 {
+		connections = defaultConnections
+	}
+
+	connChan := make(chan struct{}, connections)
+	for i := 0; i < connections; i++ {
 		connChan <- struct{}{}
 	}
+
 	tr := &http.Transport{}
-	client := http.Client{Transport: tr}
 
-	return &webdavBackend{url: cfg.URL, connChan: connChan, client: client}, nil
+	if cfg.ClientCert != "" || cfg.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "LoadX509KeyPair")
+		}
+		tr.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	client := http.Client{Transport: newAuthTransport(tr, cfg)}
+
+	lockMode := cfg.LockMode
+	if lockMode == "" {
+		lockMode = LockModeNone
+	}
+
+	lockTimeout := cfg.LockTimeout
+	if lockTimeout <= 0 {
+		lockTimeout = defaultLockTimeout
+	}
+
+	maxRetries := cfg.MaxRetries
+	if maxRetries <= 0 {
+		maxRetries = defaultMaxRetries
+	}
+
+	be := &webdavBackend{
+		url:          cfg.URL,
+		connChan:     connChan,
+		client:       client,
+		lockMode:     lockMode,
+		lockTimeout:  lockTimeout,
+		locks:        make(map[string]*lockEntry),
+		maxRetries:   maxRetries,
+		retryBackoff: defaultRetryBackoff,
+		cache:        newStatCache(cfg.StatCacheTTL),
+	}
+
+	// collections are created lazily, the first time Save hits a 409
+	// Conflict, so that read-only operations (snapshots, check, mount)
+	// against a read-only credential don't require MKCOL permission.
+	return be, nil
+}
+
+// createCollections issues MKCOL for every collection in collectionPaths
+// that does not exist yet, so a fresh, empty WebDAV share can be
+// initialized by "restic init" the same way a local repository is.
+func (b *webdavBackend) createCollections() error {
+	for _, dir := range collectionPaths {
+		if err := b.mkcol(dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mkcol creates the collection at dir, relative to the backend's URL. A 405
+// response (already exists) is not an error.
+func (b *webdavBackend) mkcol(dir string) error {
+	u := *b.url
+	u.Path = path.Join(b.url.Path, dir) + "/"
+
+	req, err := http.NewRequest("MKCOL", u.String(), nil)
+	if err != nil {
+		return errors.Wrap(err, "http.NewRequest")
+	}
+
+	<-b.connChan
+	resp, err := b.client.Do(req)
+	b.connChan <- struct{}{}
+	if err != nil {
+		return errors.Wrap(err, "client.Do")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusMethodNotAllowed:
+		return nil
+	default:
+		return errors.Errorf("MKCOL %v: unexpected HTTP response code %v", u.String(), resp.StatusCode)
+	}
+}
+
+// errLockUnsupported is returned by lockResource when the server answers a
+// LOCK request with a status indicating it doesn't implement RFC 4918
+// locking at all, as opposed to a transient failure.
+var errLockUnsupported = errors.New("server does not support WebDAV LOCK")
+
+// lockResource sends a WebDAV LOCK request for path and returns the lock
+// token from the response, per RFC 4918 section 9.10.
+func (b *webdavBackend) lockResource(path string, scope LockMode) (string, error) {
+	body := fmt.Sprintf(lockInfoXML, scope, lockOwner)
+	req, err := http.NewRequest("LOCK", path, strings.NewReader(body))
+	if err != nil {
+		return "", errors.Wrap(err, "http.NewRequest")
+	}
+	req.Header.Set("Content-Type", `application/xml; charset="utf-8"`)
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Timeout", fmt.Sprintf("Second-%d", int(b.lockTimeout.Seconds())))
+
+	<-b.connChan
+	resp, err := b.client.Do(req)
+	b.connChan <- struct{}{}
+	if err != nil {
+		return "", errors.Wrap(err, "client.Do")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return "", errLockUnsupported
+	case http.StatusOK, http.StatusCreated:
+		// locked successfully
+	default:
+		return "", errors.Errorf("LOCK %v: unexpected HTTP response code %v", path, resp.StatusCode)
+	}
+
+	token := strings.Trim(resp.Header.Get("Lock-Token"), "<>")
+	if token == "" {
+		return "", errors.New("LOCK response did not include a Lock-Token header")
+	}
+
+	return token, nil
+}
+
+// refreshLock re-locks path using an existing token before the server-side
+// timeout expires.
+func (b *webdavBackend) refreshLock(path, token string) error {
+	req, err := http.NewRequest("LOCK", path, nil)
+	if err != nil {
+		return errors.Wrap(err, "http.NewRequest")
+	}
+	req.Header.Set("If", fmt.Sprintf("(<%s>)", token))
+	req.Header.Set("Timeout", fmt.Sprintf("Second-%d", int(b.lockTimeout.Seconds())))
+
+	<-b.connChan
+	resp, err := b.client.Do(req)
+	b.connChan <- struct{}{}
+	if err != nil {
+		return errors.Wrap(err, "client.Do")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("LOCK refresh %v: unexpected HTTP response code %v", path, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// unlockResource releases a previously acquired lock.
+func (b *webdavBackend) unlockResource(path, token string) error {
+	req, err := http.NewRequest("UNLOCK", path, nil)
+	if err != nil {
+		return errors.Wrap(err, "http.NewRequest")
+	}
+	req.Header.Set("Lock-Token", fmt.Sprintf("<%s>", token))
+
+	<-b.connChan
+	resp, err := b.client.Do(req)
+	b.connChan <- struct{}{}
+	if err != nil {
+		return errors.Wrap(err, "client.Do")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return errors.Errorf("UNLOCK %v: unexpected HTTP response code %v", path, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// acquireLock locks path if the backend is configured to do so, starting a
+// goroutine that refreshes the lock until releaseLock is called. It returns
+// the lock's token, or the empty string when locking is disabled.
+func (b *webdavBackend) acquireLock(path string) (string, error) {
+	if b.lockMode == LockModeNone {
+		return "", nil
+	}
+
+	b.lockMu.Lock()
+	defer b.lockMu.Unlock()
+
+	if entry, ok := b.locks[path]; ok {
+		return entry.token, nil
+	}
+
+	token, err := b.lockResource(path, b.lockMode)
+	if err == errLockUnsupported {
+		// the server doesn't implement LOCK at all; stop trying for the
+		// lifetime of this backend instead of failing every future Save
+		// and Remove
+		b.lockMode = LockModeNone
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	entry := &lockEntry{token: token, done: make(chan struct{})}
+	b.locks[path] = entry
+
+	go b.keepLockAlive(path, entry)
+
+	return token, nil
+}
+
+// keepLockAlive refreshes entry's lock at half its timeout until entry.done
+// is closed.
+func (b *webdavBackend) keepLockAlive(path string, entry *lockEntry) {
+	interval := b.lockTimeout / 2
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.refreshLock(path, entry.token); err != nil {
+				debug.Log("error refreshing lock for %v: %v", path, err)
+			}
+		case <-entry.done:
+			return
+		}
+	}
+}
+
+// releaseLock stops refreshing and unlocks path, if it is currently locked.
+func (b *webdavBackend) releaseLock(path string) error {
+	b.lockMu.Lock()
+	entry, ok := b.locks[path]
+	if ok {
+		delete(b.locks, path)
+	}
+	b.lockMu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	close(entry.done)
+	return b.unlockResource(path, entry.token)
 }
 
 // Location returns this backend's location (the server's URL).
@@ -121,38 +416,131 @@ func (b *webdavBackend) Load(h restic.Handle, p []byte, off int64) (n int, err e
 }
 
 // Save stores data in the backend at the handle.
-func (b *webdavBackend) Save(h restic.Handle, p []byte) (err error) {
+func (b *webdavBackend) Save(h restic.Handle, p []byte) error {
+	return b.SaveFrom(h, bytes.NewReader(p), int64(len(p)))
+}
+
+// SaveFrom streams size bytes from rd to the backend at the handle, so the
+// full file does not need to be held in memory. The upload is attempted up
+// to b.maxRetries times in total, with exponential backoff between
+// attempts; retrying requires
+// replaying rd, so readers that do not implement io.Seeker are buffered
+// once into memory.
+func (b *webdavBackend) SaveFrom(h restic.Handle, rd io.Reader, size int64) error {
 	fmt.Println("Save")
 	if err := h.Valid(); err != nil {
 		return err
 	}
 
+	rs, ok := rd.(io.ReadSeeker)
+	if !ok {
+		buf, err := ioutil.ReadAll(rd)
+		if err != nil {
+			return errors.Wrap(err, "ReadAll")
+		}
+		rs = bytes.NewReader(buf)
+	}
+
 	path := restPath(b.url, h)
-	req, err := http.NewRequest("PUT", path, bytes.NewReader(p))
+
+	backoff := b.retryBackoff
+	var lastErr error
+
+	for attempt := 0; attempt < b.maxRetries; attempt++ {
+		if attempt > 0 {
+			if _, err := rs.Seek(0, io.SeekStart); err != nil {
+				return errors.Wrap(err, "Seek")
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		retry, err := b.putOnce(path, rs, size)
+		if err == nil {
+			b.cache.set(h, size)
+			return nil
+		}
+
+		lastErr = err
+		if !retry {
+			return err
+		}
+	}
+
+	return errors.Wrap(lastErr, "SaveFrom: giving up after retries")
+}
+
+// putOnce issues a single PUT of size bytes from rs to path. The returned
+// bool reports whether the error, if any, is worth retrying.
+func (b *webdavBackend) putOnce(path string, rs io.ReadSeeker, size int64) (retry bool, err error) {
+	token, err := b.acquireLock(path)
 	if err != nil {
-		return errors.Wrap(err, "http.NewRequest")
+		return true, errors.Wrap(err, "acquireLock")
+	}
+
+	req, err := http.NewRequest("PUT", path, rs)
+	if err != nil {
+		return false, errors.Wrap(err, "http.NewRequest")
+	}
+	req.ContentLength = size
+	// http.NewRequest only populates GetBody for the handful of concrete
+	// reader types it recognizes (*bytes.Reader and friends), and rs may be
+	// some other io.ReadSeeker. Set it explicitly so a request retried by
+	// the Digest auth transport actually resends the body instead of
+	// falling back to a 401 that putOnce treats as a hard failure.
+	req.GetBody = func() (io.ReadCloser, error) {
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(rs), nil
 	}
 	req.Header.Add("Translate", "f")
+	if token != "" {
+		req.Header.Set("If", fmt.Sprintf("(<%s>)", token))
+	}
+
 	<-b.connChan
 	resp, err := b.client.Do(req)
 	b.connChan <- struct{}{}
-
-	if resp != nil {
-		defer func() {
-			e := resp.Body.Close()
-
-			if err == nil {
-				err = errors.Wrap(e, "Close")
-			}
-		}()
+	if err != nil {
+		return true, errors.Wrap(err, "client.Do")
 	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		// the parent collection is most likely missing; create it and
+		// let the caller retry
+		if err := b.createCollections(); err != nil {
+			return false, errors.Wrap(err, "createCollections")
+		}
+		return true, errors.New("parent collection was missing, created")
+	case resp.StatusCode >= 500:
+		return true, errors.Errorf("Save: unexpected HTTP response code %v for %v", resp.StatusCode, path)
+	case resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent:
+		return false, errors.Errorf("Save: unexpected HTTP response code %v for %v", resp.StatusCode, path)
+	}
+
+	return false, b.verifyUpload(path, size)
+}
 
+// verifyUpload cross-checks a successful PUT against a HEAD of path, so a
+// server that silently truncated the upload is caught instead of being
+// trusted. It only compares size: WebDAV servers derive their ETags from
+// storage internals (inode+mtime, an MD5 of on-disk metadata, ...) rather
+// than a hash of the uploaded content, so there is no hash the client could
+// compute ahead of time to compare against.
+func (b *webdavBackend) verifyUpload(path string, size int64) error {
+	<-b.connChan
+	resp, err := b.client.Head(path)
+	b.connChan <- struct{}{}
 	if err != nil {
-		return errors.Wrap(err, "client.Post")
+		return errors.Wrap(err, "client.Head")
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusCreated {
-		return errors.Errorf("Save: unexpected HTTP response code %v for %v", resp.StatusCode, path)
+	if resp.ContentLength != size {
+		return errors.Errorf("Save: uploaded size mismatch for %v: wrote %v bytes, server reports %v", path, size, resp.ContentLength)
 	}
 
 	return nil
@@ -165,6 +553,10 @@ func (b *webdavBackend) Stat(h restic.Handle) (restic.FileInfo, error) {
 		return restic.FileInfo{}, err
 	}
 
+	if size, ok := b.cache.get(h); ok {
+		return restic.FileInfo{Size: size}, nil
+	}
+
 	<-b.connChan
 	resp, err := b.client.Head(restPath(b.url, h))
 	b.connChan <- struct{}{}
@@ -188,6 +580,8 @@ func (b *webdavBackend) Stat(h restic.Handle) (restic.FileInfo, error) {
 		Size: resp.ContentLength,
 	}
 
+	b.cache.set(h, resp.ContentLength)
+
 	return bi, nil
 }
 
@@ -210,10 +604,21 @@ func (b *webdavBackend) Remove(t restic.FileType, name string) error {
 		return err
 	}
 
-	req, err := http.NewRequest("DELETE", restPath(b.url, h), nil)
+	path := restPath(b.url, h)
+
+	token, err := b.acquireLock(path)
+	if err != nil {
+		return errors.Wrap(err, "acquireLock")
+	}
+
+	req, err := http.NewRequest("DELETE", path, nil)
 	if err != nil {
 		return errors.Wrap(err, "http.NewRequest")
 	}
+	if token != "" {
+		req.Header.Set("If", fmt.Sprintf("(<%s>)", token))
+	}
+
 	<-b.connChan
 	resp, err := b.client.Do(req)
 	b.connChan <- struct{}{}
@@ -226,7 +631,17 @@ func (b *webdavBackend) Remove(t restic.FileType, name string) error {
 		return errors.New("blob not removed")
 	}
 
-	return resp.Body.Close()
+	if err := resp.Body.Close(); err != nil {
+		return errors.Wrap(err, "Close")
+	}
+
+	b.cache.invalidate(h)
+
+	if token != "" {
+		return b.releaseLock(path)
+	}
+
+	return nil
 }
 
 // List returns a channel that yields all names of blobs of type t. A
@@ -236,18 +651,19 @@ func (b *webdavBackend) List(t restic.FileType, done <-chan struct{}) <-chan str
 	fmt.Println("List")
 	ch := make(chan string)
 
-	url := restPath(b.url, restic.Handle{Type: t})
-	if !strings.HasSuffix(url, "/") {
-		url += "/"
+	listURL := restPath(b.url, restic.Handle{Type: t})
+	if !strings.HasSuffix(listURL, "/") {
+		listURL += "/"
 	}
 
-	req, err := http.NewRequest("PROPFIND", url, nil)
-	req.Header.Add("Depth", "0")
+	req, err := http.NewRequest("PROPFIND", listURL, strings.NewReader(propfindBody))
 	if err != nil {
 		fmt.Printf("Error %v\n", err)
 		close(ch)
 		return ch
 	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", `application/xml; charset="utf-8"`)
 
 	<-b.connChan
 	resp, err := b.client.Do(req)
@@ -263,22 +679,43 @@ func (b *webdavBackend) List(t restic.FileType, done <-chan struct{}) <-chan str
 		return ch
 	}
 
-	//	content, _ := ioutil.ReadAll(resp.Body)
-	//	fmt.Println(string(content))
-
 	var list Multistatus
 	if err = xml.NewDecoder(resp.Body).Decode(&list); err != nil {
 		fmt.Printf("Error %v\n", err)
 		close(ch)
 		return ch
 	}
-	fmt.Println(list)
+
+	var names []string
+	for _, r := range list.Response {
+		if r.Propstat.Prop.ResourceType.Collection != nil {
+			// skip the collection itself and any nested collections
+			continue
+		}
+
+		href, err := url.QueryUnescape(r.Href)
+		if err != nil {
+			fmt.Printf("Error %v\n", err)
+			continue
+		}
+
+		name := path.Base(strings.TrimSuffix(href, "/"))
+		if name == "" || name == "." || name == "/" {
+			continue
+		}
+
+		names = append(names, name)
+
+		// PROPFIND already returned the size, so populate the cache and
+		// spare Stat a HEAD round-trip for every freshly listed file.
+		b.cache.set(restic.Handle{Type: t, Name: name}, r.Propstat.Prop.GetContentLength)
+	}
 
 	go func() {
 		defer close(ch)
-		for _, m := range list.Href {
+		for _, name := range names {
 			select {
-			case ch <- m:
+			case ch <- name:
 			case <-done:
 				return
 			}
@@ -288,9 +725,20 @@ func (b *webdavBackend) List(t restic.FileType, done <-chan struct{}) <-chan str
 	return ch
 }
 
-// Close closes all open files.
+// Close closes all open files and releases any outstanding WebDAV locks.
 func (b *webdavBackend) Close() error {
-	// this does not need to do anything, all open files are closed within the
-	// same function.
+	b.lockMu.Lock()
+	paths := make([]string, 0, len(b.locks))
+	for path := range b.locks {
+		paths = append(paths, path)
+	}
+	b.lockMu.Unlock()
+
+	for _, path := range paths {
+		if err := b.releaseLock(path); err != nil {
+			debug.Log("error unlocking %v: %v", path, err)
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,126 @@
+package webdav
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"restic"
+)
+
+func newTestBackend(t *testing.T, handler http.HandlerFunc) (*webdavBackend, *httptest.Server) {
+	srv := httptest.NewServer(handler)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connChan := make(chan struct{}, 1)
+	connChan <- struct{}{}
+
+	return &webdavBackend{
+		url:          u,
+		connChan:     connChan,
+		client:       http.Client{},
+		lockMode:     LockModeNone,
+		locks:        make(map[string]*lockEntry),
+		maxRetries:   3,
+		retryBackoff: time.Millisecond,
+		cache:        newStatCache(time.Minute),
+	}, srv
+}
+
+// TestSaveFromRetriesAfterServerError checks that SaveFrom retries a failed
+// PUT, seeking the reader back to the start before replaying it, and
+// succeeds once the server stops returning 500s.
+func TestSaveFromRetriesAfterServerError(t *testing.T) {
+	var puts int32
+
+	b, srv := newTestBackend(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "PUT":
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != "hello world" {
+				t.Errorf("server received body %q, want %q", body, "hello world")
+			}
+
+			if atomic.AddInt32(&puts, 1) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		case "HEAD":
+			w.Header().Set("Content-Length", "11")
+			w.WriteHeader(http.StatusOK)
+		default:
+			t.Fatalf("unexpected method %v", req.Method)
+		}
+	})
+	defer srv.Close()
+
+	h := restic.Handle{Type: restic.DataFile, Name: "abcdef"}
+	if err := b.SaveFrom(h, bytes.NewReader([]byte("hello world")), 11); err != nil {
+		t.Fatalf("SaveFrom returned error: %v", err)
+	}
+
+	if puts != 2 {
+		t.Fatalf("server saw %d PUTs, want 2 (one failure, one success)", puts)
+	}
+
+	if size, ok := b.cache.get(h); !ok || size != 11 {
+		t.Errorf("cache.get(h) = (%d, %v), want (11, true)", size, ok)
+	}
+}
+
+// TestSaveFromGivesUpAfterMaxRetries checks that SaveFrom stops retrying and
+// returns an error once the server keeps failing past b.maxRetries.
+func TestSaveFromGivesUpAfterMaxRetries(t *testing.T) {
+	var puts int32
+
+	b, srv := newTestBackend(t, func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&puts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer srv.Close()
+
+	h := restic.Handle{Type: restic.DataFile, Name: "abcdef"}
+	err := b.SaveFrom(h, bytes.NewReader([]byte("hello world")), 11)
+	if err == nil {
+		t.Fatal("SaveFrom returned nil error, want an error after exhausting retries")
+	}
+
+	if int(puts) != b.maxRetries {
+		t.Fatalf("server saw %d PUTs, want %d (b.maxRetries)", puts, b.maxRetries)
+	}
+}
+
+// TestSaveFromDoesNotRetryOnClientError checks that a non-retryable response
+// (e.g. a rejected PUT) is not retried at all.
+func TestSaveFromDoesNotRetryOnClientError(t *testing.T) {
+	var puts int32
+
+	b, srv := newTestBackend(t, func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&puts, 1)
+		w.WriteHeader(http.StatusForbidden)
+	})
+	defer srv.Close()
+
+	h := restic.Handle{Type: restic.DataFile, Name: "abcdef"}
+	err := b.SaveFrom(h, bytes.NewReader([]byte("hello world")), 11)
+	if err == nil {
+		t.Fatal("SaveFrom returned nil error, want an error for a 403 response")
+	}
+
+	if puts != 1 {
+		t.Fatalf("server saw %d PUTs, want 1 (no retry on a non-retryable status)", puts)
+	}
+}
@@ -0,0 +1,122 @@
+package webdav
+
+import (
+	"container/list"
+	"sync"
+
+	"restic"
+)
+
+// defaultBlobCacheEntries bounds the decrypted-blob LRU to a reasonable
+// memory footprint: at the default 128 KiB blob size, 512 entries is up to
+// 64 MiB.
+const defaultBlobCacheEntries = 512
+
+// blobCacheKey identifies a single decrypted blob.
+type blobCacheKey struct {
+	t  restic.BlobType
+	id restic.ID
+}
+
+type blobCacheEntry struct {
+	key  blobCacheKey
+	blob []byte
+}
+
+// blobCache is an LRU of decrypted blobs, shared across all requests a
+// Handler serves, so that re-reading the same file (or overlapping byte
+// ranges of it, e.g. via Range requests) doesn't mean decrypting its blobs
+// again every time.
+type blobCache struct {
+	repo BlobLoader
+	max  int
+
+	mu      sync.Mutex
+	entries map[blobCacheKey]*list.Element
+	order   *list.List
+}
+
+// newBlobCache returns a blobCache that loads misses from repo and keeps
+// at most max decrypted blobs. max <= 0 uses defaultBlobCacheEntries.
+func newBlobCache(repo BlobLoader, max int) *blobCache {
+	if max <= 0 {
+		max = defaultBlobCacheEntries
+	}
+
+	return &blobCache{
+		repo:    repo,
+		max:     max,
+		entries: make(map[blobCacheKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// LookupBlobSize implements BlobLoader by delegating directly: sizes are
+// cheap to ask for again and aren't worth caching.
+func (c *blobCache) LookupBlobSize(id restic.ID, t restic.BlobType) (uint, error) {
+	return c.repo.LookupBlobSize(id, t)
+}
+
+// LoadBlob implements BlobLoader, serving decrypted blob content from the
+// LRU when available and populating it on miss.
+func (c *blobCache) LoadBlob(t restic.BlobType, id restic.ID, buf []byte) (int, error) {
+	key := blobCacheKey{t: t, id: id}
+
+	c.mu.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		blob := elem.Value.(*blobCacheEntry).blob
+		c.mu.Unlock()
+		return copy(buf, blob), nil
+	}
+	c.mu.Unlock()
+
+	n, err := c.repo.LoadBlob(t, id, buf)
+	if err != nil {
+		return n, err
+	}
+
+	blob := make([]byte, n)
+	copy(blob, buf[:n])
+	c.insert(key, blob)
+
+	return n, nil
+}
+
+func (c *blobCache) insert(key blobCacheKey, blob []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*blobCacheEntry).blob = blob
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&blobCacheEntry{key: key, blob: blob})
+
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
+		}
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*blobCacheEntry).key)
+	}
+}
+
+// cachedRepository wraps a Repository so that LookupBlobSize/LoadBlob are
+// served from a shared blobCache instead of hitting the repository for
+// every request.
+type cachedRepository struct {
+	Repository
+	cache *blobCache
+}
+
+func (r *cachedRepository) LookupBlobSize(id restic.ID, t restic.BlobType) (uint, error) {
+	return r.cache.LookupBlobSize(id, t)
+}
+
+func (r *cachedRepository) LoadBlob(t restic.BlobType, id restic.ID, buf []byte) (int, error) {
+	return r.cache.LoadBlob(t, id, buf)
+}
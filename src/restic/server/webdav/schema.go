@@ -0,0 +1,36 @@
+package webdav
+
+import "encoding/xml"
+
+// multistatus is the body of a PROPFIND response, as described in RFC 4918
+// section 13.
+type multistatus struct {
+	XMLName  xml.Name   `xml:"D:multistatus"`
+	XMLNS    string     `xml:"xmlns:D,attr"`
+	Response []response `xml:"D:response"`
+}
+
+// response describes one resource returned by a PROPFIND request.
+type response struct {
+	Href     string   `xml:"D:href"`
+	Propstat propstat `xml:"D:propstat"`
+}
+
+type propstat struct {
+	Prop   prop   `xml:"D:prop"`
+	Status string `xml:"D:status"`
+}
+
+// prop holds the DAV properties this read-only server exposes.
+type prop struct {
+	DisplayName      string        `xml:"D:displayname"`
+	ResourceType     *resourceType `xml:"D:resourcetype,omitempty"`
+	GetContentLength int64         `xml:"D:getcontentlength,omitempty"`
+	GetLastModified  string        `xml:"D:getlastmodified,omitempty"`
+}
+
+// resourceType is present (with Collection set) for directories and absent
+// for files.
+type resourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
@@ -0,0 +1,393 @@
+// Package webdav exposes a restic repository as a read-only WebDAV server,
+// so snapshots can be browsed from any WebDAV-capable file manager (Finder,
+// Windows Explorer, GNOME Files) without FUSE or WinFsp support. It reuses
+// the same blob-loading abstraction and blob-offset bookkeeping that
+// restic/fuse uses to serve file reads.
+package webdav
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"restic"
+	"restic/debug"
+	"restic/errors"
+)
+
+const defaultBlobSize = 128 * 1024
+
+// blobPool reuses blob-sized buffers across requests, just like
+// restic/fuse's blobPool.
+var blobPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, defaultBlobSize)
+	},
+}
+
+// BlobLoader is an abstracted repository with a reduced set of methods used
+// to read file content, mirroring fuse.BlobLoader.
+type BlobLoader interface {
+	LookupBlobSize(restic.ID, restic.BlobType) (uint, error)
+	LoadBlob(restic.BlobType, restic.ID, []byte) (int, error)
+}
+
+// Repository is the interface a Handler needs to resolve
+// /snapshots/<id>/<path> URLs to a restic.Tree/restic.Node and to read the
+// resulting file's content.
+type Repository interface {
+	BlobLoader
+	List(restic.FileType, <-chan struct{}) <-chan string
+	LoadTree(restic.ID) (*restic.Tree, error)
+	LoadSnapshot(restic.ID) (*restic.Snapshot, error)
+}
+
+// Handler serves a restic repository over WebDAV, read-only. It implements
+// http.Handler.
+type Handler struct {
+	repo Repository
+}
+
+// New returns a Handler that serves repo. Decrypted blobs are cached in an
+// LRU shared across all requests the Handler serves, since the same file
+// (or overlapping byte ranges of it) is often read more than once.
+func New(repo Repository) *Handler {
+	cache := newBlobCache(repo, 0)
+	return &Handler{repo: &cachedRepository{Repository: repo, cache: cache}}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	debug.Log("%v %v", req.Method, req.URL.Path)
+
+	switch req.Method {
+	case "OPTIONS":
+		h.options(w)
+	case "PROPFIND":
+		h.propfind(w, req)
+	case "GET", "HEAD":
+		h.get(w, req)
+	case "PUT", "DELETE", "MKCOL", "MOVE", "COPY", "LOCK":
+		http.Error(w, "this WebDAV server is read-only", http.StatusForbidden)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) options(w http.ResponseWriter) {
+	w.Header().Set("DAV", "1")
+	w.Header().Set("Allow", "OPTIONS, PROPFIND, GET, HEAD")
+	w.WriteHeader(http.StatusOK)
+}
+
+// entry is a node reachable at a given URL path, used to build both
+// PROPFIND responses and file reads. tree is only set for directories and
+// holds the entry's own children.
+type entry struct {
+	urlPath string
+	node    *restic.Node
+	tree    *restic.Tree
+}
+
+// rootNode and snapshotsNode are synthetic directories: the repository has
+// no node of its own, "/" and "/snapshots" are constructed from the list of
+// snapshot IDs.
+var rootNode = &restic.Node{Name: "/", Type: "dir"}
+var snapshotsNode = &restic.Node{Name: "snapshots", Type: "dir"}
+
+// resolve maps urlPath to the entry it refers to.
+func (h *Handler) resolve(urlPath string) (*entry, error) {
+	parts := strings.Split(strings.Trim(urlPath, "/"), "/")
+	if parts[0] == "" {
+		return &entry{urlPath: "/", node: rootNode, tree: &restic.Tree{Nodes: []*restic.Node{snapshotsNode}}}, nil
+	}
+
+	if parts[0] != "snapshots" {
+		return nil, errors.Errorf("not found: %v", urlPath)
+	}
+
+	if len(parts) == 1 {
+		tree, err := h.snapshotsTree()
+		if err != nil {
+			return nil, err
+		}
+		return &entry{urlPath: "/snapshots", node: snapshotsNode, tree: tree}, nil
+	}
+
+	id, err := restic.ParseID(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "ParseID")
+	}
+
+	sn, err := h.repo.LoadSnapshot(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "LoadSnapshot")
+	}
+
+	node := &restic.Node{Name: parts[1], Type: "dir", Subtree: sn.Tree, ModTime: sn.Time}
+	tree, err := h.repo.LoadTree(*sn.Tree)
+	if err != nil {
+		return nil, errors.Wrap(err, "LoadTree")
+	}
+
+	for _, name := range parts[2:] {
+		if name == "" {
+			continue
+		}
+
+		child := findChild(tree, name)
+		if child == nil {
+			return nil, errors.Errorf("not found: %v", urlPath)
+		}
+
+		node = child
+		if node.Type == "dir" {
+			tree, err = h.repo.LoadTree(*node.Subtree)
+			if err != nil {
+				return nil, errors.Wrap(err, "LoadTree")
+			}
+		}
+	}
+
+	e := &entry{urlPath: urlPath, node: node}
+	if node.Type == "dir" {
+		e.tree = tree
+	}
+
+	return e, nil
+}
+
+func findChild(tree *restic.Tree, name string) *restic.Node {
+	for _, n := range tree.Nodes {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+// snapshotsTree builds a synthetic directory listing every snapshot ID as a
+// child node.
+func (h *Handler) snapshotsTree() (*restic.Tree, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	tree := &restic.Tree{}
+	for name := range h.repo.List(restic.SnapshotFile, done) {
+		tree.Nodes = append(tree.Nodes, &restic.Node{Name: name, Type: "dir"})
+	}
+
+	return tree, nil
+}
+
+func (h *Handler) propfind(w http.ResponseWriter, req *http.Request) {
+	e, err := h.resolve(req.URL.Path)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	responses := []response{describe(e.urlPath, e.node)}
+
+	if req.Header.Get("Depth") == "1" && e.tree != nil {
+		for _, child := range e.tree.Nodes {
+			responses = append(responses, describe(path.Join(e.urlPath, child.Name), child))
+		}
+	}
+
+	body := multistatus{XMLNS: "DAV:", Response: responses}
+
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(207)
+
+	fmt.Fprint(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	if err := enc.Encode(body); err != nil {
+		debug.Log("error encoding PROPFIND response for %v: %v", req.URL.Path, err)
+	}
+}
+
+func describe(urlPath string, node *restic.Node) response {
+	p := prop{DisplayName: node.Name}
+
+	if node.Type == "dir" {
+		p.ResourceType = &resourceType{Collection: &struct{}{}}
+	} else {
+		p.GetContentLength = int64(node.Size)
+	}
+
+	if !node.ModTime.IsZero() {
+		p.GetLastModified = node.ModTime.UTC().Format(time.RFC1123)
+	}
+
+	return response{
+		Href:     urlPath,
+		Propstat: propstat{Prop: p, Status: "HTTP/1.1 200 OK"},
+	}
+}
+
+func (h *Handler) get(w http.ResponseWriter, req *http.Request) {
+	e, err := h.resolve(req.URL.Path)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	if e.node.Type != "file" {
+		http.Error(w, "not a file", http.StatusForbidden)
+		return
+	}
+
+	f, err := newBlobFile(h.repo, e.node)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	size := int64(e.node.Size)
+	offset, length := int64(0), size
+
+	if rangeHeader := req.Header.Get("Range"); rangeHeader != "" {
+		start, end, ok := parseRange(rangeHeader, size)
+		if !ok {
+			http.Error(w, "invalid range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		offset, length = start, end-start+1
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	if req.Method == "HEAD" {
+		return
+	}
+
+	if err := f.WriteTo(w, offset, length); err != nil {
+		debug.Log("error writing response for %v: %v", req.URL.Path, err)
+	}
+}
+
+// parseRange parses a single "bytes=start-end" Range header value against a
+// resource of the given size.
+func parseRange(header string, size int64) (start, end int64, ok bool) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return 0, 0, false
+	}
+
+	spec := strings.SplitN(header[len("bytes="):], "-", 2)
+	if len(spec) != 2 {
+		return 0, 0, false
+	}
+
+	if spec[0] == "" {
+		n, err := strconv.ParseInt(spec[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		// RFC 7233: a suffix-length longer than the representation means
+		// the entire representation is used, not an error.
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true
+	}
+
+	start, err := strconv.ParseInt(spec[0], 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+
+	end = size - 1
+	if spec[1] != "" {
+		if parsed, err := strconv.ParseInt(spec[1], 10, 64); err == nil && parsed < end {
+			end = parsed
+		}
+	}
+
+	if start > end {
+		return 0, 0, false
+	}
+
+	return start, end, true
+}
+
+// blobFile streams a node's content starting at an arbitrary offset, using
+// the same blob-skipping approach as fuse.file.Read.
+type blobFile struct {
+	repo  BlobLoader
+	node  *restic.Node
+	sizes []uint
+}
+
+func newBlobFile(repo BlobLoader, node *restic.Node) (*blobFile, error) {
+	sizes := make([]uint, len(node.Content))
+	var total uint64
+	for i, id := range node.Content {
+		size, err := repo.LookupBlobSize(id, restic.DataBlob)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = size
+		total += uint64(size)
+	}
+
+	if total != node.Size {
+		debug.Log("sizes do not match: node.Size %v != size %v, using real size", node.Size, total)
+		node.Size = total
+	}
+
+	return &blobFile{repo: repo, node: node, sizes: sizes}, nil
+}
+
+// WriteTo writes length bytes of the file's content starting at offset to
+// w, loading only the blobs that overlap the requested range.
+func (f *blobFile) WriteTo(w io.Writer, offset, length int64) error {
+	startContent := 0
+	for startContent < len(f.sizes) && offset >= int64(f.sizes[startContent]) {
+		offset -= int64(f.sizes[startContent])
+		startContent++
+	}
+
+	buf := blobPool.Get().([]byte)
+	defer blobPool.Put(buf)
+
+	remaining := length
+	for i := startContent; remaining > 0 && i < len(f.sizes); i++ {
+		buf = buf[:cap(buf)]
+		if uint(len(buf)) < f.sizes[i] {
+			buf = make([]byte, f.sizes[i])
+		}
+
+		n, err := f.repo.LoadBlob(restic.DataBlob, f.node.Content[i], buf)
+		if err != nil {
+			return err
+		}
+		blob := buf[:n]
+
+		if offset > 0 {
+			blob = blob[offset:]
+			offset = 0
+		}
+		if int64(len(blob)) > remaining {
+			blob = blob[:remaining]
+		}
+
+		written, err := w.Write(blob)
+		if err != nil {
+			return err
+		}
+		remaining -= int64(written)
+	}
+
+	return nil
+}
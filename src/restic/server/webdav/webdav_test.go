@@ -0,0 +1,38 @@
+package webdav
+
+import "testing"
+
+func TestParseRange(t *testing.T) {
+	const size = int64(1000)
+
+	tests := []struct {
+		header     string
+		start, end int64
+		ok         bool
+	}{
+		{"bytes=0-499", 0, 499, true},
+		{"bytes=500-999", 500, 999, true},
+		{"bytes=500-", 500, 999, true},
+		{"bytes=-500", 500, 999, true},
+		{"bytes=-2000", 0, 999, true},
+		{"bytes=900-1500", 900, 999, true},
+		{"bytes=1000-1100", 0, 0, false},
+		{"bytes=500-100", 0, 0, false},
+		{"bytes=abc-def", 0, 0, false},
+		{"items=0-499", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		start, end, ok := parseRange(test.header, size)
+		if ok != test.ok {
+			t.Errorf("parseRange(%q, %d) ok = %v, want %v", test.header, size, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if start != test.start || end != test.end {
+			t.Errorf("parseRange(%q, %d) = (%d, %d), want (%d, %d)", test.header, size, start, end, test.start, test.end)
+		}
+	}
+}